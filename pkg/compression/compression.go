@@ -0,0 +1,513 @@
+// Package compression provides helpers for detecting, decompressing and
+// compressing image layer streams.
+package compression
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/klauspost/pgzip"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/ulikunitz/xz"
+)
+
+type (
+	// Compression is the state represents if compressed or not.
+	Compression int
+)
+
+const (
+	// Uncompressed represents the uncompressed.
+	Uncompressed Compression = iota
+	// Gzip is gzip compression algorithm.
+	Gzip
+	// Zstd is zstd compression algorithm.
+	Zstd
+	// Bzip2 is bzip2 compression algorithm.
+	Bzip2
+	// Xz is xz compression algorithm.
+	Xz
+)
+
+var (
+	bufioReader32KPool = &sync.Pool{
+		New: func() interface{} { return bufio.NewReaderSize(nil, 32*1024) },
+	}
+)
+
+// DecompressReadCloser include the stream after decompress and the compress method detected.
+type DecompressReadCloser interface {
+	io.ReadCloser
+	// GetCompression returns the compress method which is used before decompressing
+	GetCompression() Compression
+}
+
+type readCloserWrapper struct {
+	io.Reader
+	compression Compression
+	closer      func() error
+}
+
+func (r *readCloserWrapper) Close() error {
+	if r.closer != nil {
+		return r.closer()
+	}
+	return nil
+}
+
+func (r *readCloserWrapper) GetCompression() Compression {
+	return r.compression
+}
+
+type writeCloserWrapper struct {
+	io.Writer
+	closer func() error
+}
+
+func (w *writeCloserWrapper) Close() error {
+	if w.closer != nil {
+		w.closer()
+	}
+	return nil
+}
+
+// codec carries everything needed to detect, decode and encode a single
+// compression format.
+type codec struct {
+	magic     []byte
+	newReader func(io.Reader) (io.ReadCloser, error)
+	newWriter func(io.Writer) io.WriteCloser
+	ext       string
+
+	// newWriterWithOptions, when set, lets CompressStreamWithOptions pass
+	// level/concurrency/dictionary tuning through to the encoder. It is
+	// only ever set by this package's own registrations below; it is
+	// cleared whenever RegisterCompression replaces a codec, so a
+	// downstream override always takes effect (tuned or not).
+	newWriterWithOptions func(io.Writer, CompressOptions) (io.WriteCloser, error)
+}
+
+var (
+	registryMu sync.Mutex
+	registry   = map[Compression]*codec{}
+)
+
+// RegisterCompression registers a codec for id, identified by its magic
+// bytes, so DetectCompression, DecompressStream, CompressStream and
+// Extension all pick it up. newWriter may be nil for decode-only formats.
+// Registering an id a second time replaces the previous codec.
+func RegisterCompression(id Compression, magic []byte, newReader func(io.Reader) (io.ReadCloser, error), newWriter func(io.Writer) io.WriteCloser, ext string) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registry[id] = &codec{
+		magic:     magic,
+		newReader: newReader,
+		newWriter: newWriter,
+		ext:       ext,
+	}
+}
+
+func lookupCompression(id Compression) (*codec, bool) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	c, ok := registry[id]
+	return c, ok
+}
+
+// registerTunableWriter attaches an options-aware encoder to an id already
+// registered via RegisterCompression. It's only used by this package's own
+// init() below, since newWriterWithOptions isn't part of the public
+// RegisterCompression API.
+func registerTunableWriter(id Compression, newWriterWithOptions func(io.Writer, CompressOptions) (io.WriteCloser, error)) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if c, ok := registry[id]; ok {
+		c.newWriterWithOptions = newWriterWithOptions
+	}
+}
+
+func init() {
+	RegisterCompression(Gzip, []byte{0x1F, 0x8B, 0x08}, func(r io.Reader) (io.ReadCloser, error) {
+		return gzip.NewReader(r)
+	}, func(w io.Writer) io.WriteCloser {
+		return gzip.NewWriter(w)
+	}, "gz")
+	registerTunableWriter(Gzip, newGzipWriter)
+
+	RegisterCompression(Zstd, []byte{0x28, 0xB5, 0x2F, 0xFD}, func(r io.Reader) (io.ReadCloser, error) {
+		zstdReader, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return zstdReader.IOReadCloser(), nil
+	}, func(w io.Writer) io.WriteCloser {
+		zstdWriter, err := zstd.NewWriter(w)
+		if err != nil {
+			// only returns an error when options are invalid, which
+			// cannot happen with the defaults used here.
+			panic(err)
+		}
+		return zstdWriter
+	}, "zst")
+	registerTunableWriter(Zstd, newZstdWriter)
+
+	RegisterCompression(Bzip2, []byte{'B', 'Z', 'h'}, func(r io.Reader) (io.ReadCloser, error) {
+		return io.NopCloser(bzip2.NewReader(r)), nil
+	}, nil, "bz2")
+	RegisterCompression(Xz, []byte{0xFD, '7', 'z', 'X', 'Z', 0x00}, func(r io.Reader) (io.ReadCloser, error) {
+		xzReader, err := xz.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(xzReader), nil
+	}, nil, "xz")
+}
+
+// DetectCompression detects the compression algorithm of the source.
+func DetectCompression(source []byte) Compression {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	for id, c := range registry {
+		if len(source) < len(c.magic) {
+			// Len too short
+			continue
+		}
+		if bytes.Equal(c.magic, source[:len(c.magic)]) {
+			return id
+		}
+	}
+	return Uncompressed
+}
+
+// PeekCompression detects the compression algorithm of r without decoding
+// it, returning a replacement reader that replays the peeked bytes.
+func PeekCompression(r io.Reader) (Compression, io.Reader, error) {
+	buf := bufio.NewReaderSize(r, 32*1024)
+	bs, err := buf.Peek(10)
+	if err != nil && err != io.EOF {
+		return Uncompressed, buf, err
+	}
+	return DetectCompression(bs), buf, nil
+}
+
+// GetCompression opens a stream via opener just long enough to sniff its
+// compression.
+func GetCompression(opener func() (io.ReadCloser, error)) (Compression, error) {
+	rc, err := opener()
+	if err != nil {
+		return Uncompressed, err
+	}
+	defer rc.Close()
+
+	compression, _, err := PeekCompression(rc)
+	if err != nil {
+		return Uncompressed, err
+	}
+	return compression, nil
+}
+
+// DecompressStream decompresses the archive and returns a ReaderCloser with the decompressed archive.
+func DecompressStream(archive io.Reader) (DecompressReadCloser, error) {
+	return DecompressStreamContext(context.Background(), archive)
+}
+
+// DecompressStreamContext is like DecompressStream but uses ctx to bound any
+// pigz/unpigz subprocess spawned for Gzip archives.
+func DecompressStreamContext(ctx context.Context, archive io.Reader) (DecompressReadCloser, error) {
+	buf := bufioReader32KPool.Get().(*bufio.Reader)
+	buf.Reset(archive)
+	bs, err := buf.Peek(10)
+	if err != nil && err != io.EOF {
+		// Note: we'll ignore any io.EOF error because there are some odd
+		// cases where the layer.tar file will be empty (zero bytes) and
+		// that results in an io.EOF from the Peek() call. So, in those
+		// cases we'll just treat it as a non-compressed stream and
+		// that means just create an empty layer.
+		// See Issue docker/docker#18170
+		return nil, err
+	}
+
+	closer := func() error {
+		buf.Reset(nil)
+		bufioReader32KPool.Put(buf)
+		return nil
+	}
+
+	compression := DetectCompression(bs)
+	if compression == Uncompressed {
+		readBufWrapper := &readCloserWrapper{buf, compression, closer}
+		return readBufWrapper, nil
+	}
+
+	if compression == Gzip {
+		if path, args, ok := pigzCommand(); ok {
+			if pr, err := newPigzReader(ctx, path, args, buf); err == nil {
+				readBufWrapper := &readCloserWrapper{pr, compression, func() error {
+					pigzErr := pr.Close()
+					closer()
+					return pigzErr
+				}}
+				return readBufWrapper, nil
+			}
+			// Couldn't start pigz; fall through to the pure-Go decoder.
+		}
+	}
+
+	c, ok := lookupCompression(compression)
+	if !ok || c.newReader == nil {
+		return nil, fmt.Errorf("unsupported compression format %s", (&compression).Extension())
+	}
+	reader, err := c.newReader(buf)
+	if err != nil {
+		return nil, err
+	}
+	readBufWrapper := &readCloserWrapper{reader, compression, closer}
+	return readBufWrapper, nil
+}
+
+// pigzCommand reports the path and arguments of an external gzip
+// decompressor, or ok=false if none is available or the fast path is disabled.
+func pigzCommand() (path string, args []string, ok bool) {
+	if os.Getenv("GOCONTAINERD_DISABLE_PIGZ") == "1" {
+		return "", nil, false
+	}
+	if p, err := exec.LookPath("unpigz"); err == nil {
+		return p, nil, true
+	}
+	if p, err := exec.LookPath("pigz"); err == nil {
+		return p, []string{"-d"}, true
+	}
+	return "", nil, false
+}
+
+// pigzReader decompresses through an external pigz/unpigz process.
+type pigzReader struct {
+	cmd     *exec.Cmd
+	stdout  io.ReadCloser
+	stderr  bytes.Buffer
+	cancel  context.CancelFunc
+	eofSeen bool
+}
+
+func newPigzReader(ctx context.Context, path string, args []string, r io.Reader) (*pigzReader, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	cmd := exec.CommandContext(ctx, path, args...)
+	cmd.Stdin = r
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	pr := &pigzReader{cmd: cmd, stdout: stdout, cancel: cancel}
+	cmd.Stderr = &pr.stderr
+
+	if err := cmd.Start(); err != nil {
+		cancel()
+		return nil, err
+	}
+	return pr, nil
+}
+
+func (p *pigzReader) Read(b []byte) (int, error) {
+	n, err := p.stdout.Read(b)
+	if err == io.EOF {
+		p.eofSeen = true
+	}
+	return n, err
+}
+
+// Close kills the subprocess if still running, so an early abandonment can't
+// deadlock it writing to a full stdout pipe nobody is draining, then reaps it
+// and surfaces any real failure (with stderr attached).
+func (p *pigzReader) Close() error {
+	abortedEarly := !p.eofSeen
+	p.cancel()
+	err := p.cmd.Wait()
+	if err == nil {
+		return nil
+	}
+	if abortedEarly {
+		return nil
+	}
+	if msg := strings.TrimSpace(p.stderr.String()); msg != "" {
+		return fmt.Errorf("%s: %w: %s", p.cmd.Path, err, msg)
+	}
+	return fmt.Errorf("%s: %w", p.cmd.Path, err)
+}
+
+// CompressOptions tunes the encoder used by CompressStreamWithOptions. The
+// zero value means "codec defaults" (see Concurrency for what that means for
+// parallelism).
+type CompressOptions struct {
+	// Level is the codec-specific compression level, nil meaning the
+	// codec's default. gzip accepts -2 (huffman-only) through 9 (best
+	// compression), including 0 (no compression); zstd accepts 1 through
+	// 22. A pointer is used so an explicit 0 (valid for gzip) can be told
+	// apart from "not set".
+	Level *int
+	// Concurrency is the number of worker goroutines the encoder may use,
+	// for codecs that support parallel compression (zstd's built-in
+	// workers, gzip via pgzip). For gzip, 0 or 1 means single-threaded; for
+	// zstd, 0 leaves the encoder's own default (GOMAXPROCS workers).
+	Concurrency int
+	// Dictionary is a trained dictionary to prime the encoder with.
+	// Currently only honored for Zstd.
+	Dictionary []byte
+}
+
+// pgzipBlockSize is the per-worker input block size passed to pgzip when
+// CompressOptions.Concurrency > 1.
+const pgzipBlockSize = 1 << 20
+
+// CompressStream compresseses the dest with specified compression algorithm.
+func CompressStream(dest io.Writer, compression Compression) (io.WriteCloser, error) {
+	return CompressStreamWithOptions(dest, compression, CompressOptions{})
+}
+
+// CompressStreamWithOptions is like CompressStream but lets callers tune the
+// compression level, parallelism and (for Zstd) a trained dictionary via
+// opts, for codecs that support it. Like CompressStream, it goes through the
+// codec registry, so a RegisterCompression override of Gzip or Zstd is
+// honored here too (opts are ignored unless the override also registers a
+// tunable writer, which RegisterCompression itself cannot do).
+func CompressStreamWithOptions(dest io.Writer, compression Compression, opts CompressOptions) (io.WriteCloser, error) {
+	if compression == Uncompressed {
+		return &writeCloserWrapper{dest, nil}, nil
+	}
+
+	c, ok := lookupCompression(compression)
+	if !ok {
+		return nil, fmt.Errorf("unsupported compression format %s", (&compression).Extension())
+	}
+	if c.newWriterWithOptions != nil {
+		return c.newWriterWithOptions(dest, opts)
+	}
+	if c.newWriter == nil {
+		return nil, fmt.Errorf("unsupported compression format %s", (&compression).Extension())
+	}
+	return c.newWriter(dest), nil
+}
+
+func newGzipWriter(dest io.Writer, opts CompressOptions) (io.WriteCloser, error) {
+	level := gzip.DefaultCompression
+	if opts.Level != nil {
+		level = *opts.Level
+	}
+	if opts.Concurrency > 1 {
+		pw, err := pgzip.NewWriterLevel(dest, level)
+		if err != nil {
+			return nil, err
+		}
+		if err := pw.SetConcurrency(pgzipBlockSize, opts.Concurrency); err != nil {
+			return nil, err
+		}
+		return pw, nil
+	}
+	return gzip.NewWriterLevel(dest, level)
+}
+
+func newZstdWriter(dest io.Writer, opts CompressOptions) (io.WriteCloser, error) {
+	var zopts []zstd.EOption
+	if opts.Level != nil {
+		zopts = append(zopts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(*opts.Level)))
+	}
+	if opts.Concurrency > 0 {
+		zopts = append(zopts, zstd.WithEncoderConcurrency(opts.Concurrency))
+	}
+	if len(opts.Dictionary) > 0 {
+		zopts = append(zopts, zstd.WithEncoderDict(opts.Dictionary))
+	}
+	return zstd.NewWriter(dest, zopts...)
+}
+
+// Extension returns the extension of a file that uses the specified compression algorithm.
+func (compression *Compression) Extension() string {
+	if c, ok := lookupCompression(*compression); ok {
+		return c.ext
+	}
+	return ""
+}
+
+// CountingWriteCloser wraps an io.WriteCloser, counting the bytes written
+// through it before forwarding them on.
+type CountingWriteCloser struct {
+	io.WriteCloser
+	n int64
+}
+
+func (c *CountingWriteCloser) Write(p []byte) (int, error) {
+	n, err := c.WriteCloser.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// Size returns the number of bytes written through the wrapper so far.
+func (c *CountingWriteCloser) Size() int64 {
+	return c.n
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// DigestFn reports the digest.Digest accumulated by the DecompressReadCloser
+// returned alongside it from DecompressStreamWithDigest.
+type DigestFn func() digest.Digest
+
+type digestReadCloser struct {
+	DecompressReadCloser
+	compressed *CountingWriteCloser
+	n          int64
+	digester   digest.Digester
+}
+
+func (d *digestReadCloser) Read(p []byte) (int, error) {
+	n, err := d.DecompressReadCloser.Read(p)
+	if n > 0 {
+		d.digester.Hash().Write(p[:n])
+		d.n += int64(n)
+	}
+	return n, err
+}
+
+// Size returns the number of decompressed bytes read so far.
+func (d *digestReadCloser) Size() int64 {
+	return d.n
+}
+
+// CompressedSize returns the number of compressed bytes consumed from the
+// underlying stream so far.
+func (d *digestReadCloser) CompressedSize() int64 {
+	return d.compressed.Size()
+}
+
+// DecompressStreamWithDigest wraps DecompressStream, returning a DigestFn for
+// the digest of the decompressed bytes once the reader has been fully read.
+func DecompressStreamWithDigest(r io.Reader, algo digest.Algorithm) (DecompressReadCloser, DigestFn, error) {
+	compressedCounter := &CountingWriteCloser{WriteCloser: nopWriteCloser{io.Discard}}
+	dr, err := DecompressStream(io.TeeReader(r, compressedCounter))
+	if err != nil {
+		return nil, nil, err
+	}
+	digester := algo.Digester()
+	wrapped := &digestReadCloser{
+		DecompressReadCloser: dr,
+		compressed:           compressedCounter,
+		digester:             digester,
+	}
+	return wrapped, digester.Digest, nil
+}
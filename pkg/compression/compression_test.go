@@ -0,0 +1,463 @@
+package compression
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	digest "github.com/opencontainers/go-digest"
+	"github.com/ulikunitz/xz"
+)
+
+// bzip2 has no encoder in the Go standard library, so this fixture is
+// `printf '...' | bzip2 -c` captured once and replayed here.
+const bzip2HelloFixtureB64 = "QlpoOTFBWSZTWfAmkoIAABGRgEAAP///8CAAIqemkGJpiNpmpCmjQBoAAmKiKEl+rFZzPwrmO5PHxzwp+IxqBXbWvxdyRThQkPAmkoI="
+
+func TestDetectCompression(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		source []byte
+		want   Compression
+	}{
+		{"empty", nil, Uncompressed},
+		{"gzip", []byte{0x1F, 0x8B, 0x08, 0x00}, Gzip},
+		{"zstd", []byte{0x28, 0xB5, 0x2F, 0xFD}, Zstd},
+		{"bzip2", []byte("BZh91AY&SY"), Bzip2},
+		{"xz", []byte{0xFD, '7', 'z', 'X', 'Z', 0x00, 0x00}, Xz},
+		{"plain", []byte("hello world"), Uncompressed},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := DetectCompression(tc.source); got != tc.want {
+				t.Fatalf("DetectCompression() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestCompressDecompressRoundTrip(t *testing.T) {
+	for _, compression := range []Compression{Uncompressed, Gzip, Zstd} {
+		t.Run((&compression).Extension(), func(t *testing.T) {
+			want := []byte("the quick brown fox jumps over the lazy dog")
+
+			var buf bytes.Buffer
+			w, err := CompressStream(&buf, compression)
+			if err != nil {
+				t.Fatalf("CompressStream: %v", err)
+			}
+			if _, err := w.Write(want); err != nil {
+				t.Fatalf("Write: %v", err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatalf("Close writer: %v", err)
+			}
+
+			r, err := DecompressStream(&buf)
+			if err != nil {
+				t.Fatalf("DecompressStream: %v", err)
+			}
+			defer r.Close()
+
+			if got := r.GetCompression(); got != compression {
+				t.Fatalf("GetCompression() = %v, want %v", got, compression)
+			}
+
+			got, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatalf("ReadAll: %v", err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Fatalf("round trip = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestDecompressBzip2(t *testing.T) {
+	raw, err := base64.StdEncoding.DecodeString(bzip2HelloFixtureB64)
+	if err != nil {
+		t.Fatalf("decode fixture: %v", err)
+	}
+
+	r, err := DecompressStream(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("DecompressStream: %v", err)
+	}
+	defer r.Close()
+
+	if got := r.GetCompression(); got != Bzip2 {
+		t.Fatalf("GetCompression() = %v, want %v", got, Bzip2)
+	}
+
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	want := "the quick brown fox jumps over the lazy dog"
+	if string(got) != want {
+		t.Fatalf("decompressed = %q, want %q", got, want)
+	}
+}
+
+func TestDecompressXz(t *testing.T) {
+	want := "the quick brown fox jumps over the lazy dog"
+
+	var buf bytes.Buffer
+	w, err := xz.NewWriter(&buf)
+	if err != nil {
+		t.Fatalf("xz.NewWriter: %v", err)
+	}
+	if _, err := w.Write([]byte(want)); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close writer: %v", err)
+	}
+
+	r, err := DecompressStream(&buf)
+	if err != nil {
+		t.Fatalf("DecompressStream: %v", err)
+	}
+	defer r.Close()
+
+	if got := r.GetCompression(); got != Xz {
+		t.Fatalf("GetCompression() = %v, want %v", got, Xz)
+	}
+
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if string(got) != want {
+		t.Fatalf("decompressed = %q, want %q", got, want)
+	}
+}
+
+func TestRegisterCompressionCustomCodec(t *testing.T) {
+	const testID Compression = 1000
+	RegisterCompression(testID, []byte{0xAA, 0xBB}, func(r io.Reader) (io.ReadCloser, error) {
+		return io.NopCloser(r), nil
+	}, func(w io.Writer) io.WriteCloser {
+		return &writeCloserWrapper{w, nil}
+	}, "test")
+	defer func() {
+		registryMu.Lock()
+		delete(registry, testID)
+		registryMu.Unlock()
+	}()
+
+	if got := DetectCompression([]byte{0xAA, 0xBB, 0x01}); got != testID {
+		t.Fatalf("DetectCompression() = %v, want %v", got, testID)
+	}
+	if got := (&[]Compression{testID}[0]).Extension(); got != "test" {
+		t.Fatalf("Extension() = %q, want %q", got, "test")
+	}
+}
+
+func TestCompressStreamWithOptionsHonorsRegisterCompressionOverride(t *testing.T) {
+	var overrideUsed bool
+	orig, ok := lookupCompression(Gzip)
+	if !ok {
+		t.Fatal("Gzip not registered")
+	}
+	RegisterCompression(Gzip, orig.magic, orig.newReader, func(w io.Writer) io.WriteCloser {
+		overrideUsed = true
+		return &writeCloserWrapper{w, nil}
+	}, orig.ext)
+	defer func() {
+		registryMu.Lock()
+		registry[Gzip] = orig
+		registryMu.Unlock()
+	}()
+
+	var buf bytes.Buffer
+	w, err := CompressStreamWithOptions(&buf, Gzip, CompressOptions{})
+	if err != nil {
+		t.Fatalf("CompressStreamWithOptions() error = %v", err)
+	}
+	if _, err := w.Write([]byte("hello")); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if !overrideUsed {
+		t.Fatal("CompressStreamWithOptions() did not use the RegisterCompression override")
+	}
+	if buf.String() != "hello" {
+		t.Fatalf("output = %q, want %q (override writes uncompressed)", buf.String(), "hello")
+	}
+}
+
+func TestExtension(t *testing.T) {
+	for _, tc := range []struct {
+		compression Compression
+		want        string
+	}{
+		{Uncompressed, ""},
+		{Gzip, "gz"},
+		{Zstd, "zst"},
+		{Bzip2, "bz2"},
+		{Xz, "xz"},
+	} {
+		if got := (&tc.compression).Extension(); got != tc.want {
+			t.Fatalf("Extension() for %v = %q, want %q", tc.compression, got, tc.want)
+		}
+	}
+}
+
+func TestDecompressStreamContextPigzFallback(t *testing.T) {
+	t.Setenv("GOCONTAINERD_DISABLE_PIGZ", "1")
+	if _, _, ok := pigzCommand(); ok {
+		t.Fatal("pigzCommand() should be disabled by GOCONTAINERD_DISABLE_PIGZ")
+	}
+
+	want := []byte("the quick brown fox jumps over the lazy dog")
+	var buf bytes.Buffer
+	w, err := CompressStream(&buf, Gzip)
+	if err != nil {
+		t.Fatalf("CompressStream: %v", err)
+	}
+	if _, err := w.Write(want); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close writer: %v", err)
+	}
+
+	r, err := DecompressStreamContext(context.Background(), &buf)
+	if err != nil {
+		t.Fatalf("DecompressStreamContext: %v", err)
+	}
+	defer r.Close()
+
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("decompressed = %q, want %q", got, want)
+	}
+}
+
+// TestPigzReaderCloseEarlyDoesNotHang is a regression test: closing a
+// pigzReader before its stdout has been read to EOF must not deadlock
+// waiting on a subprocess blocked writing to an undrained pipe.
+func TestPigzReaderCloseEarlyDoesNotHang(t *testing.T) {
+	// "cat" stands in for unpigz here: fed enough input to fill the stdout
+	// pipe several times over, it will block on its own Write once nobody
+	// reads, exactly like unpigz would on a large layer.
+	input := bytes.Repeat([]byte("x"), 8<<20)
+
+	pr, err := newPigzReader(context.Background(), "cat", nil, bytes.NewReader(input))
+	if err != nil {
+		t.Fatalf("newPigzReader: %v", err)
+	}
+
+	small := make([]byte, 1024)
+	if _, err := pr.Read(small); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- pr.Close() }()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Close: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close() hung instead of killing the subprocess")
+	}
+}
+
+func intPtr(i int) *int { return &i }
+
+func compress(t *testing.T, compression Compression, opts CompressOptions, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := CompressStreamWithOptions(&buf, compression, opts)
+	if err != nil {
+		t.Fatalf("CompressStreamWithOptions: %v", err)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close writer: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestCompressStreamWithOptionsLevelZeroIsNoCompression(t *testing.T) {
+	data := bytes.Repeat([]byte("a"), 64<<10)
+
+	noCompression := compress(t, Gzip, CompressOptions{Level: intPtr(gzip.NoCompression)}, data)
+	best := compress(t, Gzip, CompressOptions{Level: intPtr(gzip.BestCompression)}, data)
+
+	if len(noCompression) <= len(best) {
+		t.Fatalf("Level: 0 (NoCompression) produced %d bytes, not bigger than BestCompression's %d", len(noCompression), len(best))
+	}
+
+	r, err := DecompressStream(bytes.NewReader(noCompression))
+	if err != nil {
+		t.Fatalf("DecompressStream: %v", err)
+	}
+	defer r.Close()
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("round trip through Level: 0 did not reproduce the original data")
+	}
+}
+
+func TestCompressStreamWithOptionsConcurrency(t *testing.T) {
+	data := bytes.Repeat([]byte("the quick brown fox jumps over the lazy dog. "), 1<<16)
+
+	out := compress(t, Gzip, CompressOptions{Concurrency: 4}, data)
+
+	r, err := DecompressStream(bytes.NewReader(out))
+	if err != nil {
+		t.Fatalf("DecompressStream: %v", err)
+	}
+	defer r.Close()
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("round trip through concurrent pgzip did not reproduce the original data")
+	}
+}
+
+func TestCompressStreamWithOptionsZstd(t *testing.T) {
+	data := []byte("the quick brown fox jumps over the lazy dog")
+
+	out := compress(t, Zstd, CompressOptions{}, data)
+
+	r, err := DecompressStream(bytes.NewReader(out))
+	if err != nil {
+		t.Fatalf("DecompressStream: %v", err)
+	}
+	defer r.Close()
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("zstd round trip via CompressStreamWithOptions did not reproduce the original data")
+	}
+}
+
+func TestPeekCompression(t *testing.T) {
+	want := []byte("the quick brown fox jumps over the lazy dog")
+	gzipped := compress(t, Gzip, CompressOptions{}, want)
+
+	compression, r, err := PeekCompression(bytes.NewReader(gzipped))
+	if err != nil {
+		t.Fatalf("PeekCompression: %v", err)
+	}
+	if compression != Gzip {
+		t.Fatalf("PeekCompression() compression = %v, want %v", compression, Gzip)
+	}
+
+	// The replayed reader must still carry all the peeked bytes, so
+	// DecompressStream can consume it from the start.
+	dr, err := DecompressStream(r)
+	if err != nil {
+		t.Fatalf("DecompressStream: %v", err)
+	}
+	defer dr.Close()
+	got, err := io.ReadAll(dr)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("decompressed = %q, want %q", got, want)
+	}
+}
+
+func TestGetCompression(t *testing.T) {
+	gzipped := compress(t, Gzip, CompressOptions{}, []byte("hello"))
+
+	compression, err := GetCompression(func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(gzipped)), nil
+	})
+	if err != nil {
+		t.Fatalf("GetCompression: %v", err)
+	}
+	if compression != Gzip {
+		t.Fatalf("GetCompression() = %v, want %v", compression, Gzip)
+	}
+
+	wantErr := errors.New("open failed")
+	if _, err := GetCompression(func() (io.ReadCloser, error) {
+		return nil, wantErr
+	}); !errors.Is(err, wantErr) {
+		t.Fatalf("GetCompression() err = %v, want %v", err, wantErr)
+	}
+}
+
+func TestDecompressStreamWithDigest(t *testing.T) {
+	want := []byte("the quick brown fox jumps over the lazy dog")
+	gzipped := compress(t, Gzip, CompressOptions{}, want)
+	wantDigest := digest.Canonical.FromBytes(want)
+
+	r, digestFn, err := DecompressStreamWithDigest(bytes.NewReader(gzipped), digest.Canonical)
+	if err != nil {
+		t.Fatalf("DecompressStreamWithDigest: %v", err)
+	}
+	defer r.Close()
+
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("decompressed = %q, want %q", got, want)
+	}
+
+	if gotDigest := digestFn(); gotDigest != wantDigest {
+		t.Fatalf("digest = %v, want %v", gotDigest, wantDigest)
+	}
+
+	sized, ok := r.(interface {
+		Size() int64
+		CompressedSize() int64
+	})
+	if !ok {
+		t.Fatal("DecompressReadCloser does not expose Size/CompressedSize")
+	}
+	if got := sized.Size(); got != int64(len(want)) {
+		t.Fatalf("Size() = %d, want %d", got, len(want))
+	}
+	if got := sized.CompressedSize(); got != int64(len(gzipped)) {
+		t.Fatalf("CompressedSize() = %d, want %d", got, len(gzipped))
+	}
+}
+
+func TestCountingWriteCloser(t *testing.T) {
+	var buf bytes.Buffer
+	c := &CountingWriteCloser{WriteCloser: nopWriteCloser{&buf}}
+
+	if _, err := c.Write([]byte("hello")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if _, err := c.Write([]byte(", world")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	if got, want := c.Size(), int64(len("hello, world")); got != want {
+		t.Fatalf("Size() = %d, want %d", got, want)
+	}
+	if got, want := buf.String(), "hello, world"; got != want {
+		t.Fatalf("underlying writer = %q, want %q", got, want)
+	}
+}